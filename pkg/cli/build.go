@@ -0,0 +1,303 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/replicate/cog/pkg/config"
+	"github.com/startingapr21/rogue/pkg/docker"
+	"github.com/startingapr21/rogue/pkg/dockerfile"
+	"github.com/startingapr21/rogue/pkg/util/console"
+)
+
+const defaultConfigFilename = "cog.yaml"
+
+func newBuildCommand() *cobra.Command {
+	var (
+		tag             string
+		format          string
+		separateWeights bool
+		pushCache       bool
+		cacheRegistry   string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "build",
+		Short: "Build an image from cog.yaml",
+		Long: `Build an image from cog.yaml.
+
+--format=singularity builds an Apptainer/Singularity recipe and .sif instead of a Docker
+image, for HPC users who don't have a Docker daemon available.
+
+--separate-weights builds model weights into their own cacheable image layer first, so
+unchanged weights don't have to be re-copied into every build.
+
+--push-cache tags the apt, pip-deps and (with --separate-weights) weights stages under
+<registry>/<stage>:<hash> and pushes them, so a later build with unchanged inputs on any
+machine can pull the stage instead of rebuilding it.
+
+--cache-registry sets the <registry> those tags are minted under (default "cog-cache", a
+bare namespace that only resolves on Docker Hub). Set it to a registry/repository you can
+actually push to, e.g. "ghcr.io/my-org/cog-cache".`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runBuild(tag, format, separateWeights, pushCache, cacheRegistry)
+		},
+	}
+
+	cmd.Flags().StringVarP(&tag, "tag", "t", "", "A name for the built image, e.g. 'repository:tag'")
+	cmd.Flags().StringVar(&format, "format", "docker", `Output format to build: "docker" or "singularity"`)
+	cmd.Flags().BoolVar(&separateWeights, "separate-weights", false, "Build model weights into their own cacheable layer")
+	cmd.Flags().BoolVar(&pushCache, "push-cache", false, "Push cacheable stages to the configured cache registry for reuse on future builds")
+	cmd.Flags().StringVar(&cacheRegistry, "cache-registry", "", `Registry/repository prefix to tag cache stages under (default "cog-cache")`)
+	return cmd
+}
+
+func runBuild(tag, format string, separateWeights, pushCache bool, cacheRegistry string) error {
+	dir, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("Failed to determine the current directory: %w", err)
+	}
+
+	cfg, projectDir, err := config.GetConfig(filepath.Join(dir, defaultConfigFilename))
+	if err != nil {
+		return fmt.Errorf("Failed to read %s: %w", defaultConfigFilename, err)
+	}
+
+	generator, err := dockerfile.NewGenerator(cfg, projectDir)
+	if err != nil {
+		return fmt.Errorf("Failed to set up the build: %w", err)
+	}
+	defer generator.Cleanup()
+
+	if cacheRegistry != "" {
+		generator.SetCacheRegistry(cacheRegistry)
+	}
+
+	switch format {
+	case "", "docker":
+		return buildDocker(generator, projectDir, tag, separateWeights, pushCache)
+	case "singularity":
+		return buildSingularity(generator, projectDir, tag, separateWeights)
+	default:
+		return fmt.Errorf(`Unknown --format %q: must be "docker" or "singularity"`, format)
+	}
+}
+
+func buildDocker(generator *dockerfile.Generator, projectDir, tag string, separateWeights, pushCache bool) error {
+	imageName := tag
+	if imageName == "" {
+		imageName = "cog"
+	}
+
+	var dockerfileContents string
+	if separateWeights {
+		weightsDockerfile, contents, dockerignoreContents, err := generator.GenerateModelBaseWithSeparateWeights(imageName)
+		if err != nil {
+			return fmt.Errorf("Failed to generate Dockerfile: %w", err)
+		}
+		dockerfileContents = contents
+
+		if err := writeFile(filepath.Join(projectDir, ".dockerignore"), dockerignoreContents); err != nil {
+			return err
+		}
+		if err := buildWeightsStage(generator, projectDir, weightsDockerfile, imageName, pushCache); err != nil {
+			return err
+		}
+	} else {
+		contents, err := generator.GenerateDockerfileWithoutSeparateWeights()
+		if err != nil {
+			return fmt.Errorf("Failed to generate Dockerfile: %w", err)
+		}
+		dockerfileContents = contents
+	}
+
+	dockerfilePath := filepath.Join(projectDir, ".cog", "Dockerfile")
+	if err := writeFile(dockerfilePath, dockerfileContents); err != nil {
+		return err
+	}
+
+	if err := buildCachedDepsStages(generator, projectDir, dockerfilePath, pushCache); err != nil {
+		return err
+	}
+
+	args := []string{"build", "-f", dockerfilePath}
+	if tag != "" {
+		args = append(args, "-t", tag)
+	}
+	args = append(args, projectDir)
+
+	return runCommand(projectDir, "docker", args...)
+}
+
+// buildWeightsStage builds (or reuses, from cog-cache) the standalone weights image a
+// separate-weights Dockerfile's "FROM <imageName>-weights" stage expects to already exist
+// locally, tagging it imageName+"-weights".
+func buildWeightsStage(generator *dockerfile.Generator, projectDir, weightsDockerfile, imageName string, pushCache bool) error {
+	weightsTag := imageName + "-weights"
+	cacheTag, err := generator.WeightsCacheTag()
+	if err != nil {
+		return fmt.Errorf("Failed to compute the weights cache tag: %w", err)
+	}
+
+	local := docker.ImageExistsLocally(cacheTag)
+	if local || docker.RemoteManifestExists(cacheTag) {
+		console.Debugf("Reusing cached weights image %s", cacheTag)
+		if !local {
+			if err := docker.Pull(cacheTag); err != nil {
+				return fmt.Errorf("Failed to pull cache entry %s: %w", cacheTag, err)
+			}
+		}
+		if err := docker.Tag(cacheTag, weightsTag); err != nil {
+			return fmt.Errorf("Failed to tag %s as %s: %w", cacheTag, weightsTag, err)
+		}
+		return nil
+	}
+
+	weightsDockerfilePath := filepath.Join(projectDir, ".cog", "weights.Dockerfile")
+	if err := writeFile(weightsDockerfilePath, weightsDockerfile); err != nil {
+		return err
+	}
+	if err := runCommand(projectDir, "docker", "build", "-f", weightsDockerfilePath, "-t", weightsTag, projectDir); err != nil {
+		return fmt.Errorf("Failed to build weights image: %w", err)
+	}
+	return dockerfile.PersistCachedStage(weightsTag, cacheTag, pushCache)
+}
+
+// buildCachedDepsStages builds the apt-deps and (pip) deps stages ahead of the final
+// build, tagging each under its cog-cache tag (and pushing when pushCache is set) so a
+// later build with unchanged inputs hits resolveCachedStage instead of rebuilding them.
+func buildCachedDepsStages(generator *dockerfile.Generator, projectDir, dockerfilePath string, pushCache bool) error {
+	if generator.IsUsingCogBaseImage() {
+		// cog base images don't have a separate apt-deps/deps stage to cache.
+		return nil
+	}
+
+	baseImage, err := generator.BaseImage()
+	if err != nil {
+		return err
+	}
+
+	if len(generator.Config.Build.SystemPackages) > 0 {
+		if err := buildCachedStage(projectDir, dockerfilePath, "apt-deps", generator.AptCacheTag(baseImage), pushCache); err != nil {
+			return err
+		}
+	}
+
+	if !generator.UsingConda() {
+		if err := buildCachedStage(projectDir, dockerfilePath, "deps", generator.PipDepsCacheTag(), pushCache); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// buildCachedStage builds dockerfilePath's named stage and tags (and optionally pushes)
+// it under tag, or does nothing if tag already exists locally or in a remote registry --
+// the generated Dockerfile's FROM line for this stage will already have been rewritten to
+// pull it via resolveCachedStage in that case.
+func buildCachedStage(projectDir, dockerfilePath, stage, tag string, push bool) error {
+	if docker.ImageExistsLocally(tag) || docker.RemoteManifestExists(tag) {
+		return nil
+	}
+
+	iidFile, err := os.CreateTemp("", "cog-"+stage+"-iid-*")
+	if err != nil {
+		return fmt.Errorf("Failed to create a temp file for --iidfile: %w", err)
+	}
+	iidFile.Close()
+	defer os.Remove(iidFile.Name())
+
+	if err := runCommand(projectDir, "docker", "build", "-f", dockerfilePath, "--target", stage, "--iidfile", iidFile.Name(), projectDir); err != nil {
+		return fmt.Errorf("Failed to build %s stage: %w", stage, err)
+	}
+
+	builtRef, err := os.ReadFile(iidFile.Name())
+	if err != nil {
+		return fmt.Errorf("Failed to read the built %s stage's image ID: %w", stage, err)
+	}
+
+	return dockerfile.PersistCachedStage(strings.TrimSpace(string(builtRef)), tag, push)
+}
+
+func buildSingularity(generator *dockerfile.Generator, projectDir, tag string, separateWeights bool) error {
+	sif := tag
+	if sif == "" {
+		sif = "cog.sif"
+	}
+	if !strings.HasSuffix(sif, ".sif") {
+		sif += ".sif"
+	}
+
+	if separateWeights {
+		return buildSingularityWithSeparateWeights(generator, projectDir, sif)
+	}
+
+	def, err := generator.GenerateSingularityDef()
+	if err != nil {
+		return fmt.Errorf("Failed to generate Singularity recipe: %w", err)
+	}
+
+	defPath := filepath.Join(projectDir, ".cog", "singularity.def")
+	if err := writeFile(defPath, def); err != nil {
+		return err
+	}
+
+	return runCommand(projectDir, "apptainer", "build", sif, defPath)
+}
+
+// buildSingularityWithSeparateWeights builds the standalone weights .sif the main recipe's
+// "Bootstrap: localimage" stage expects to already exist (on every run; a .sif left by a
+// previous build is not reused), then builds the main recipe on top of it --
+// the Singularity counterpart to buildWeightsStage/buildDocker's separate-weights path.
+func buildSingularityWithSeparateWeights(generator *dockerfile.Generator, projectDir, sif string) error {
+	weightsSif := strings.TrimSuffix(sif, ".sif") + "-weights.sif"
+
+	weightsDef, def, err := generator.GenerateSingularityDefWithSeparateWeights(weightsSif)
+	if err != nil {
+		return fmt.Errorf("Failed to generate Singularity recipe: %w", err)
+	}
+
+	weightsDefPath := filepath.Join(projectDir, ".cog", "weights.singularity.def")
+	if err := writeFile(weightsDefPath, weightsDef); err != nil {
+		return err
+	}
+	if err := runCommand(projectDir, "apptainer", "build", weightsSif, weightsDefPath); err != nil {
+		return fmt.Errorf("Failed to build weights .sif: %w", err)
+	}
+
+	defPath := filepath.Join(projectDir, ".cog", "singularity.def")
+	if err := writeFile(defPath, def); err != nil {
+		return err
+	}
+
+	return runCommand(projectDir, "apptainer", "build", sif, defPath)
+}
+
+func writeFile(path, contents string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("Failed to write %s: %w", path, err)
+	}
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		return fmt.Errorf("Failed to write %s: %w", path, err)
+	}
+	return nil
+}
+
+func runCommand(dir, name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Dir = dir
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	console.Debug("$ " + strings.Join(cmd.Args, " "))
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Failed to run %s: %w", name, err)
+	}
+	return nil
+}
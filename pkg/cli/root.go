@@ -0,0 +1,16 @@
+// Package cli assembles the cog CLI's command tree.
+package cli
+
+import "github.com/spf13/cobra"
+
+// NewRootCommand builds the cog root command and wires up its subcommands.
+func NewRootCommand() (*cobra.Command, error) {
+	rootCmd := &cobra.Command{
+		Use:           "cog",
+		Short:         "Containers for machine learning",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	}
+	rootCmd.AddCommand(newBuildCommand())
+	return rootCmd, nil
+}
@@ -0,0 +1,17 @@
+package docker
+
+import "os/exec"
+
+// ImageExistsLocally reports whether ref is already present in the local Docker daemon's
+// image store, without attempting to pull it.
+func ImageExistsLocally(ref string) bool {
+	cmd := exec.Command("docker", "image", "inspect", ref)
+	return cmd.Run() == nil
+}
+
+// RemoteManifestExists reports whether ref resolves to an existing manifest in its remote
+// registry, without pulling the image.
+func RemoteManifestExists(ref string) bool {
+	cmd := exec.Command("docker", "manifest", "inspect", ref)
+	return cmd.Run() == nil
+}
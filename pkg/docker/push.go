@@ -17,3 +17,25 @@ func Push(image string) error {
 	console.Debug("$ " + strings.Join(cmd.Args, " "))
 	return cmd.Run()
 }
+
+// Tag runs `docker tag <ref> <newTag>`, e.g. to alias a just-built stage under its
+// content-addressed cog-cache tag before Push-ing it.
+func Tag(ref, newTag string) error {
+	cmd := exec.Command("docker", "tag", ref, newTag)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	console.Debug("$ " + strings.Join(cmd.Args, " "))
+	return cmd.Run()
+}
+
+// Pull runs `docker pull <ref>`, e.g. to fetch a cog-cache stage RemoteManifestExists
+// already confirmed exists, so it can be retagged as a build stage's expected name.
+func Pull(ref string) error {
+	cmd := exec.Command("docker", "pull", ref)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	console.Debug("$ " + strings.Join(cmd.Args, " "))
+	return cmd.Run()
+}
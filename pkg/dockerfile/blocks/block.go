@@ -0,0 +1,142 @@
+// Package blocks implements the building-block model that
+// github.com/startingapr21/rogue/pkg/dockerfile assembles generated Dockerfiles from,
+// mirroring the HPCCM building-block approach (baseimage, packages, shell, environment,
+// label). Each Block renders one fragment of the final Dockerfile and declares, by name,
+// which other blocks must render before it; Resolve orders an arbitrary set of blocks
+// accordingly. Consumers outside pkg/dockerfile can implement Block themselves to add
+// steps (installing TensorRT, pre-fetching a HuggingFace model, setting up Jupyter)
+// without forking cog.
+package blocks
+
+import "fmt"
+
+// BuildContext carries the subset of generator state blocks need to render their
+// Dockerfile fragment. It's intentionally decoupled from dockerfile.Generator so blocks
+// can be implemented and tested without importing cog's internal config/generator types.
+type BuildContext struct {
+	BaseImage      string
+	PythonVersion  string
+	SystemPackages []string
+	Requirements   string
+	RunCommands    []RunCommand
+	ModelPaths     []string
+
+	UserName string
+	UserUID  int
+	UserGID  int
+
+	// AptInstall, CogInstall and PipInstall let a caller that already has a way to render
+	// these steps (e.g. one that needs to write a temp file and COPY it in, which this
+	// package deliberately has no access to) hand AptPackagesBlock/CogWheelBlock/
+	// PipDepsBlock a pre-rendered fragment to use verbatim instead of deriving one from
+	// SystemPackages/Requirements. AptPackagesBlock and PipDepsBlock fall back to their own
+	// plain rendering when the corresponding field is empty; CogWheelBlock then renders
+	// nothing.
+	AptInstall string
+	CogInstall string
+	PipInstall string
+}
+
+// RunCommand is the block-API equivalent of a config.RunItem's command.
+type RunCommand struct {
+	Command    string
+	Privileged bool
+	Mounts     []RunMount
+}
+
+// RunMount is the block-API equivalent of a config.RunItem's secret mount.
+type RunMount struct {
+	Type   string
+	ID     string
+	Target string
+}
+
+// Block is a single, named fragment of a generated Dockerfile.
+type Block interface {
+	// Name identifies the block so other blocks can declare it as a dependency.
+	Name() string
+	// Render produces this block's Dockerfile fragment, or "" to contribute nothing.
+	Render(ctx *BuildContext) (string, error)
+	// Requires lists the names of blocks that must render before this one.
+	Requires() []string
+}
+
+// Resolve orders a set of blocks so that every block appears after everything in its
+// Requires() list, via a depth-first topological sort. It errors on an unknown dependency
+// or a dependency cycle.
+func Resolve(registered []Block) ([]Block, error) {
+	byName := make(map[string]Block, len(registered))
+	for _, b := range registered {
+		byName[b.Name()] = b
+	}
+
+	const (
+		unvisited = 0
+		visiting  = 1
+		done      = 2
+	)
+	state := make(map[string]int, len(registered))
+	ordered := make([]Block, 0, len(registered))
+
+	var visit func(b Block) error
+	visit = func(b Block) error {
+		switch state[b.Name()] {
+		case done:
+			return nil
+		case visiting:
+			return fmt.Errorf("dockerfile/blocks: cycle detected at block %q", b.Name())
+		}
+		state[b.Name()] = visiting
+		for _, dep := range b.Requires() {
+			depBlock, ok := byName[dep]
+			if !ok {
+				return fmt.Errorf("dockerfile/blocks: block %q requires unknown block %q", b.Name(), dep)
+			}
+			if err := visit(depBlock); err != nil {
+				return err
+			}
+		}
+		state[b.Name()] = done
+		ordered = append(ordered, b)
+		return nil
+	}
+
+	for _, b := range registered {
+		if err := visit(b); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
+
+// Render resolves dependency order and concatenates every block's rendered output,
+// skipping blocks that render to "" so optional steps don't leave stray blank lines.
+func Render(registered []Block, ctx *BuildContext) (string, error) {
+	ordered, err := Resolve(registered)
+	if err != nil {
+		return "", err
+	}
+
+	lines := make([]string, 0, len(ordered))
+	for _, b := range ordered {
+		out, err := b.Render(ctx)
+		if err != nil {
+			return "", fmt.Errorf("dockerfile/blocks: rendering block %q: %w", b.Name(), err)
+		}
+		if out != "" {
+			lines = append(lines, out)
+		}
+	}
+	return joinNonEmpty(lines), nil
+}
+
+func joinNonEmpty(lines []string) string {
+	out := ""
+	for i, l := range lines {
+		if i > 0 {
+			out += "\n"
+		}
+		out += l
+	}
+	return out
+}
@@ -0,0 +1,199 @@
+package blocks
+
+import (
+	"fmt"
+	"strings"
+)
+
+// BaseImageBlock emits the Dockerfile's FROM line.
+type BaseImageBlock struct{}
+
+func (BaseImageBlock) Name() string       { return "base_image" }
+func (BaseImageBlock) Requires() []string { return nil }
+func (BaseImageBlock) Render(ctx *BuildContext) (string, error) {
+	if ctx.BaseImage == "" {
+		return "", fmt.Errorf("build context has no base image set")
+	}
+	return "FROM " + ctx.BaseImage, nil
+}
+
+// TiniBlock installs tini as the image's PID 1 entrypoint.
+type TiniBlock struct{}
+
+func (TiniBlock) Name() string       { return "tini" }
+func (TiniBlock) Requires() []string { return []string{"base_image"} }
+func (TiniBlock) Render(ctx *BuildContext) (string, error) {
+	return `RUN --mount=type=cache,target=/var/cache/apt,sharing=locked set -eux; \
+apt-get update -qq && \
+apt-get install -qqy --no-install-recommends curl; \
+rm -rf /var/lib/apt/lists/*; \
+TINI_VERSION=v0.19.0; \
+TINI_ARCH="$(dpkg --print-architecture)"; \
+curl -sSL -o /sbin/tini "https://github.com/krallin/tini/releases/download/${TINI_VERSION}/tini-${TINI_ARCH}"; \
+chmod +x /sbin/tini
+ENTRYPOINT ["/sbin/tini", "--"]`, nil
+}
+
+// AptPackagesBlock installs config.Build.SystemPackages.
+type AptPackagesBlock struct{}
+
+func (AptPackagesBlock) Name() string       { return "apt_packages" }
+func (AptPackagesBlock) Requires() []string { return []string{"base_image"} }
+func (AptPackagesBlock) Render(ctx *BuildContext) (string, error) {
+	if ctx.AptInstall != "" {
+		return ctx.AptInstall, nil
+	}
+	if len(ctx.SystemPackages) == 0 {
+		return "", nil
+	}
+	return "RUN --mount=type=cache,target=/var/cache/apt,sharing=locked apt-get update -qq && apt-get install -qqy " +
+		strings.Join(ctx.SystemPackages, " ") +
+		" && rm -rf /var/lib/apt/lists/*", nil
+}
+
+// PyenvPythonBlock installs the configured Python version via pyenv, mirroring
+// installPythonCUDA in pkg/dockerfile/generator.go: the apt packages pyenv needs to compile
+// Python from source, the momo-lab/pyenv-install-latest plugin (install-latest isn't a
+// built-in pyenv subcommand), and the pip/wheel bootstrap the pip_deps block's `pip install`
+// needs afterwards.
+type PyenvPythonBlock struct{}
+
+func (PyenvPythonBlock) Name() string       { return "pyenv_python" }
+func (PyenvPythonBlock) Requires() []string { return []string{"apt_packages"} }
+func (PyenvPythonBlock) Render(ctx *BuildContext) (string, error) {
+	if ctx.PythonVersion == "" {
+		return "", nil
+	}
+	return fmt.Sprintf(`ENV PATH="/root/.pyenv/shims:/root/.pyenv/bin:$PATH"
+RUN --mount=type=cache,target=/var/cache/apt,sharing=locked apt-get update -qq && apt-get install -qqy --no-install-recommends \
+	make \
+	build-essential \
+	libssl-dev \
+	zlib1g-dev \
+	libbz2-dev \
+	libreadline-dev \
+	libsqlite3-dev \
+	wget \
+	curl \
+	llvm \
+	libncurses5-dev \
+	libncursesw5-dev \
+	xz-utils \
+	tk-dev \
+	libffi-dev \
+	liblzma-dev \
+	git \
+	ca-certificates \
+	&& rm -rf /var/lib/apt/lists/*
+RUN curl -s -S -L https://raw.githubusercontent.com/pyenv/pyenv-installer/master/bin/pyenv-installer | bash && \
+	git clone https://github.com/momo-lab/pyenv-install-latest.git "$(pyenv root)"/plugins/pyenv-install-latest && \
+	pyenv install-latest "%s" && \
+	pyenv global $(pyenv install-latest --print "%s") && \
+	pip install "wheel<1"`, ctx.PythonVersion, ctx.PythonVersion), nil
+}
+
+// CogWheelBlock installs the embedded cog Python package. It's a no-op when ctx.CogInstall
+// is empty, e.g. for a base image (like cog's own) that already bundles cog.
+type CogWheelBlock struct{}
+
+func (CogWheelBlock) Name() string       { return "cog_wheel" }
+func (CogWheelBlock) Requires() []string { return []string{"base_image"} }
+func (CogWheelBlock) Render(ctx *BuildContext) (string, error) {
+	return ctx.CogInstall, nil
+}
+
+// PipDepsBlock installs the generated requirements.txt.
+type PipDepsBlock struct{}
+
+func (PipDepsBlock) Name() string       { return "pip_deps" }
+func (PipDepsBlock) Requires() []string { return []string{"pyenv_python", "cog_wheel"} }
+func (PipDepsBlock) Render(ctx *BuildContext) (string, error) {
+	if ctx.PipInstall != "" {
+		return ctx.PipInstall, nil
+	}
+	if strings.TrimSpace(ctx.Requirements) == "" {
+		return "", nil
+	}
+	return "RUN --mount=type=cache,target=/root/.cache/pip pip install -r /tmp/requirements.txt", nil
+}
+
+// WeightsCopyBlock copies model weight paths in from the weights build stage, for
+// separate-weights builds. It renders to "" when ctx.ModelPaths is empty, i.e. for builds
+// that don't separate weights into their own stage. It requires run_commands (not just
+// base_image) because the "weights" stage it copies from is only spliced in by
+// GenerateModelBaseWithSeparateWeights after the rest of the pipeline has rendered, and a
+// build.run step that writes under one of ctx.ModelPaths should lose to the weights COPY,
+// the same ordering GenerateModelBaseWithSeparateWeights uses for its hand-assembled paths.
+type WeightsCopyBlock struct{}
+
+func (WeightsCopyBlock) Name() string       { return "weights_copy" }
+func (WeightsCopyBlock) Requires() []string { return []string{"run_commands"} }
+func (WeightsCopyBlock) Render(ctx *BuildContext) (string, error) {
+	if len(ctx.ModelPaths) == 0 {
+		return "", nil
+	}
+	chown := ""
+	if ctx.UserName != "" {
+		chown = "--chown=" + ctx.UserName + ":" + ctx.UserName + " "
+	}
+	lines := make([]string, 0, len(ctx.ModelPaths))
+	for _, p := range ctx.ModelPaths {
+		lines = append(lines, "COPY --from=weights --link "+chown+p+" "+p)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// UserAccountBlock provisions the configured non-root runtime user and switches to it.
+type UserAccountBlock struct{}
+
+func (UserAccountBlock) Name() string       { return "user_account" }
+func (UserAccountBlock) Requires() []string { return []string{"apt_packages"} }
+func (UserAccountBlock) Render(ctx *BuildContext) (string, error) {
+	if ctx.UserName == "" {
+		return "", nil
+	}
+	return fmt.Sprintf(`RUN groupadd -g %d %s && useradd -m -u %d -g %d %s
+RUN mkdir -p /src && chown -R %s:%s /src
+USER %s`, ctx.UserGID, ctx.UserName, ctx.UserUID, ctx.UserGID, ctx.UserName, ctx.UserName, ctx.UserName, ctx.UserName), nil
+}
+
+// RunCommandsBlock emits the user's build.run steps, gating any privileged: true step
+// back up to root and down to the runtime user again.
+type RunCommandsBlock struct{}
+
+func (RunCommandsBlock) Name() string       { return "run_commands" }
+func (RunCommandsBlock) Requires() []string { return []string{"pip_deps", "user_account"} }
+func (RunCommandsBlock) Render(ctx *BuildContext) (string, error) {
+	lines := make([]string, 0, len(ctx.RunCommands))
+	for _, run := range ctx.RunCommands {
+		command := strings.TrimSpace(run.Command)
+		if command == "" {
+			continue
+		}
+		if strings.Contains(command, "\n") {
+			return "", fmt.Errorf(`one of the commands in 'run' contains a new line, which won't work. You need to create a new list item in YAML prefixed with '-' for each command.
+
+This is the offending line: %s`, command)
+		}
+
+		var line string
+		if len(run.Mounts) > 0 {
+			mounts := []string{}
+			for _, mount := range run.Mounts {
+				if mount.Type == "secret" {
+					mounts = append(mounts, fmt.Sprintf("--mount=type=secret,id=%s,target=%s", mount.ID, mount.Target))
+				}
+			}
+			line = fmt.Sprintf("RUN %s %s", strings.Join(mounts, " "), command)
+		} else {
+			line = "RUN " + command
+		}
+
+		if run.Privileged && ctx.UserName != "" {
+			lines = append(lines, "USER root", line, "USER "+ctx.UserName)
+		} else {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
@@ -0,0 +1,119 @@
+package dockerfile
+
+import (
+	"path"
+
+	"github.com/startingapr21/rogue/pkg/dockerfile/blocks"
+)
+
+// cogBaseImagePipeline is the block pipeline generateInitialSteps renders for
+// useCogBaseImage builds. The cog base image already bundles Python, tini and cog itself,
+// so only system packages, pip requirements, the runtime user and build.run steps need
+// rendering here; pyenv_python and cog_wheel stay in the pipeline purely so other blocks
+// can declare them as a dependency, and render to nothing by default. The conda, ROCm and
+// content-addressed-caching paths aren't expressible as this fixed block set and are still
+// hand-wired in generateInitialSteps.
+var cogBaseImagePipeline = []blocks.Block{
+	blocks.BaseImageBlock{},
+	blocks.AptPackagesBlock{},
+	blocks.PyenvPythonBlock{},
+	blocks.CogWheelBlock{},
+	blocks.PipDepsBlock{},
+	blocks.UserAccountBlock{},
+	blocks.RunCommandsBlock{},
+	blocks.WeightsCopyBlock{},
+}
+
+// RegisterBlock adds a custom building block to the generated Dockerfile, so downstream
+// tools can add steps (installing TensorRT, pre-fetching a HuggingFace model, setting up
+// Jupyter) without forking cog. Blocks run in the dependency order their Requires()
+// declares against the built-in block names: base_image, apt_packages, pyenv_python,
+// cog_wheel, pip_deps, user_account, run_commands. This works the same way for every build
+// path (cog base image, conda, plain pip/pyenv, CUDA, ROCm) -- registered blocks always
+// render after run_commands, regardless of how the rest of the Dockerfile was assembled.
+// Outside the cog base image path, a separate-weights build appends its weights COPY
+// lines after them.
+func (g *Generator) RegisterBlock(b blocks.Block) {
+	g.extraBlocks = append(g.extraBlocks, b)
+}
+
+// extraBlockAnchors stand in for the built-in block names outside the useCogBaseImage
+// pipeline, where those steps are assembled by hand in generateInitialSteps rather than
+// rendered through the blocks package. They let a registered block declare a dependency on
+// e.g. "pip_deps" in every build mode without the blocks package re-rendering (and
+// duplicating) a step it didn't produce in the first place.
+var extraBlockAnchors = []blocks.Block{
+	anchorBlock("base_image"),
+	anchorBlock("apt_packages"),
+	anchorBlock("pyenv_python"),
+	anchorBlock("cog_wheel"),
+	anchorBlock("pip_deps"),
+	anchorBlock("user_account"),
+	anchorBlock("run_commands"),
+}
+
+// anchorBlock is a named no-op Block, used to satisfy extraBlocks' Requires() against
+// built-in block names in build paths that don't render those steps through the blocks
+// package.
+type anchorBlock string
+
+func (b anchorBlock) Name() string     { return string(b) }
+func (anchorBlock) Requires() []string { return nil }
+func (anchorBlock) Render(*blocks.BuildContext) (string, error) {
+	return "", nil
+}
+
+// renderExtraBlocks renders g.extraBlocks (see RegisterBlock) against extraBlockAnchors, so
+// callers outside the useCogBaseImage pipeline can still honor registered blocks. Returns ""
+// when nothing's registered.
+func (g *Generator) renderExtraBlocks(ctx *blocks.BuildContext) (string, error) {
+	if len(g.extraBlocks) == 0 {
+		return "", nil
+	}
+	pipeline := append(append([]blocks.Block{}, extraBlockAnchors...), g.extraBlocks...)
+	return blocks.Render(pipeline, ctx)
+}
+
+// cogBaseImageBuildContext assembles the blocks.BuildContext cogBaseImagePipeline renders
+// from, pre-rendering the apt/pip fragments through the existing aptInstalls/pipInstalls
+// (which need Generator's tmpDir to write requirements.txt) rather than reimplementing
+// that in the blocks package.
+func (g *Generator) cogBaseImageBuildContext(baseImage string) (*blocks.BuildContext, error) {
+	aptInstall, err := g.aptInstalls()
+	if err != nil {
+		return nil, err
+	}
+	pipInstall, err := g.pipInstalls()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := &blocks.BuildContext{
+		BaseImage:  baseImage,
+		AptInstall: aptInstall,
+		PipInstall: pipInstall,
+	}
+	if g.usesNonRootUser() {
+		ctx.UserName, ctx.UserUID, ctx.UserGID = g.runtimeUser()
+	}
+	// Of the Dockerfile generators, only GenerateModelBaseWithSeparateWeights populates
+	// g.modelDirs/g.modelFiles, before it calls generateInitialSteps -- empty here means
+	// this isn't a separate-weights build, so WeightsCopyBlock renders nothing.
+	for _, p := range append(g.modelDirs, g.modelFiles...) {
+		ctx.ModelPaths = append(ctx.ModelPaths, path.Join("/src", p))
+	}
+
+	for _, run := range g.Config.Build.Run {
+		rc := blocks.RunCommand{Command: run.Command, Privileged: run.Privileged}
+		for _, mount := range run.Mounts {
+			rc.Mounts = append(rc.Mounts, blocks.RunMount{Type: mount.Type, ID: mount.ID, Target: mount.Target})
+		}
+		ctx.RunCommands = append(ctx.RunCommands, rc)
+	}
+	// For backwards compatibility, mirroring runCommands().
+	for _, command := range g.Config.Build.PreInstall {
+		ctx.RunCommands = append(ctx.RunCommands, blocks.RunCommand{Command: command})
+	}
+
+	return ctx, nil
+}
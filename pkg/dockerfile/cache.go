@@ -0,0 +1,201 @@
+package dockerfile
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/startingapr21/rogue/pkg/docker"
+)
+
+// DefaultCacheRegistry is the repository build stages are tagged under when
+// content-addressed caching is enabled and the build doesn't configure its own, e.g.
+// cog-cache/pip-deps:<hash>. It's a bare namespace with no registry host, so it only
+// resolves on Docker Hub -- callers who don't own that Hub org must set
+// Generator.SetCacheRegistry (wired to cog build's --cache-registry flag) to a registry
+// they can actually push to.
+const DefaultCacheRegistry = "cog-cache"
+
+// stageCacheTag returns a deterministic <registry>/<stage>:<hash> tag for a build stage,
+// derived from a SHA256 over its declared inputs. Inputs are hashed in the order given, so
+// callers must keep that order stable for the tag to stay reusable across builds.
+func stageCacheTag(registry, stage string, inputs ...string) string {
+	h := sha256.New()
+	for _, input := range inputs {
+		h.Write([]byte(input))
+		h.Write([]byte{0})
+	}
+	return fmt.Sprintf("%s/%s:%s", registry, stage, hex.EncodeToString(h.Sum(nil))[:16])
+}
+
+// aptStageCacheTag hashes the sorted system package list together with the base image
+// they're installed on top of, since apt-get install order doesn't change the resulting
+// layer but a different base image would.
+func aptStageCacheTag(registry, baseImage string, packages []string) string {
+	sorted := append([]string{}, packages...)
+	sort.Strings(sorted)
+	return stageCacheTag(registry, "apt", append([]string{baseImage}, sorted...)...)
+}
+
+// pipDepsStageCacheTag hashes the normalized requirements.txt contents together with the
+// Python/CUDA/Torch triple and the embedded Cog wheel, since changing any of them changes
+// the resulting deps layer.
+func pipDepsStageCacheTag(registry, requirementsTxt, pythonVersion, cudaVersion, torchVersion string) string {
+	wheelHash := sha256.Sum256(cogWheelEmbed)
+	return stageCacheTag(
+		registry,
+		"pip-deps",
+		normalizeRequirements(requirementsTxt),
+		pythonVersion,
+		cudaVersion,
+		torchVersion,
+		hex.EncodeToString(wheelHash[:]),
+	)
+}
+
+// weightsContentHash returns a SHA256 digest over every model weight file's path and
+// content (walking modelDirs the same way GenerateWeightsManifest does), not just the set
+// of paths -- retraining a model and pushing new weights to an unchanged path must not
+// hash the same as the stale build, or a stale weights image would look like a cache hit.
+func (g *Generator) weightsContentHash() (string, error) {
+	files := append([]string{}, g.modelFiles...)
+	for _, dir := range g.modelDirs {
+		err := g.fileWalker(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+			files = append(files, path)
+			return nil
+		})
+		if err != nil {
+			return "", fmt.Errorf("Failed to walk %s while hashing model weights: %w", dir, err)
+		}
+	}
+	sort.Strings(files)
+
+	h := sha256.New()
+	for _, f := range files {
+		contents, err := os.ReadFile(f)
+		if err != nil {
+			return "", fmt.Errorf("Failed to hash model weight file %s: %w", f, err)
+		}
+		h.Write([]byte(f))
+		h.Write([]byte{0})
+		h.Write(contents)
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// weightsStageCacheTag hashes the content (not just the paths) of every model weight file
+// baked into the weights stage, so an unchanged set of weight files -- same paths, same
+// bytes -- can reuse a previously built weights image, and a changed one can't.
+func (g *Generator) weightsStageCacheTag() (string, error) {
+	contentHash, err := g.weightsContentHash()
+	if err != nil {
+		return "", err
+	}
+	sorted := append(append([]string{}, g.modelDirs...), g.modelFiles...)
+	sort.Strings(sorted)
+	return stageCacheTag(g.cacheRegistry(), "weights", append(sorted, contentHash)...), nil
+}
+
+// normalizeRequirements sorts and trims a requirements.txt so that reordered-but-identical
+// dependency sets still hash to the same tag.
+func normalizeRequirements(requirementsTxt string) string {
+	lines := strings.Split(strings.TrimSpace(requirementsTxt), "\n")
+	trimmed := make([]string, 0, len(lines))
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		trimmed = append(trimmed, line)
+	}
+	sort.Strings(trimmed)
+	return strings.Join(trimmed, "\n")
+}
+
+// cacheHit reports whether tag already exists, locally or in a configured remote registry,
+// so its stage can be reused instead of rebuilt.
+func cacheHit(tag string) bool {
+	return docker.ImageExistsLocally(tag) || docker.RemoteManifestExists(tag)
+}
+
+// resolveCachedStage rewrites a "FROM <image> as <stage>" line to instead pull a
+// previously-built cog-cache tag when one already exists locally or in a configured remote
+// registry, so unchanged dependency sets skip straight to a cache hit instead of a real
+// build. The caller should also skip re-running the stage's own install steps when hit is
+// true, since the cached image's filesystem already has them applied.
+func resolveCachedStage(fromLine, stage, tag string) (result string, hit bool) {
+	if cacheHit(tag) {
+		return fmt.Sprintf("FROM %s as %s", tag, stage), true
+	}
+	return fromLine, false
+}
+
+// PersistCachedStage tags builtRef -- the image a `docker build --target <stage>` of the
+// generated Dockerfile just produced -- as tag, and pushes it when push is true. Callers
+// should invoke this once a stage build succeeds, using the matching *CacheTag accessor
+// below, so that a later build with the same inputs hits resolveCachedStage instead of
+// rebuilding the stage from scratch.
+func PersistCachedStage(builtRef, tag string, push bool) error {
+	if err := docker.Tag(builtRef, tag); err != nil {
+		return fmt.Errorf("Failed to tag %s as cache entry %s: %w", builtRef, tag, err)
+	}
+	if !push {
+		return nil
+	}
+	if err := docker.Push(tag); err != nil {
+		return fmt.Errorf("Failed to push cache entry %s: %w", tag, err)
+	}
+	return nil
+}
+
+// cacheRegistry returns the registry/repository prefix cache tags are minted under: the
+// Generator.SetCacheRegistry override (wired to cog build's --cache-registry flag) if one
+// was configured, or DefaultCacheRegistry otherwise.
+func (g *Generator) cacheRegistry() string {
+	if g.cacheRegistryOverride != "" {
+		return g.cacheRegistryOverride
+	}
+	return DefaultCacheRegistry
+}
+
+// SetCacheRegistry overrides the registry/repository prefix content-addressed cache stages
+// are tagged and pushed/pulled under, instead of the DefaultCacheRegistry bare namespace
+// that only resolves on Docker Hub. registry should include a host for anything other than
+// Docker Hub, e.g. "ghcr.io/my-org/cog-cache".
+func (g *Generator) SetCacheRegistry(registry string) {
+	g.cacheRegistryOverride = registry
+}
+
+// AptCacheTag returns the deterministic tag the apt-deps stage (see aptInstallStage) would
+// reuse on a future build with the same base image and system_packages. Call
+// PersistCachedStage with this tag and the "apt-deps" stage's build ref after a successful
+// build.
+func (g *Generator) AptCacheTag(baseImage string) string {
+	return aptStageCacheTag(g.cacheRegistry(), baseImage, g.Config.Build.SystemPackages)
+}
+
+// PipDepsCacheTag returns the deterministic tag pipInstallStage would reuse on a future
+// build with the same requirements/Python/CUDA/Torch inputs. Call PersistCachedStage with
+// this tag and the "deps" stage's build ref after a successful build.
+func (g *Generator) PipDepsCacheTag() string {
+	torchVersion, _ := g.Config.TorchVersion()
+	return pipDepsStageCacheTag(g.cacheRegistry(), g.pythonRequirementsContents, g.Config.Build.PythonVersion, g.Config.Build.CUDA, torchVersion)
+}
+
+// WeightsCacheTag returns the deterministic tag for the current set of model weight
+// files' paths and content, so callers can check for (or, after a build, persist) a cached
+// weights image instead of rebuilding <imageName>-weights whenever the weight files
+// haven't changed.
+func (g *Generator) WeightsCacheTag() (string, error) {
+	return g.weightsStageCacheTag()
+}
@@ -0,0 +1,43 @@
+package dockerfile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/replicate/cog/pkg/config"
+)
+
+// TestWeightsCacheTagChangesWithContent guards against the cache tag being derived from
+// weight file paths alone: retraining a model and pushing new weights to the same path
+// must change the tag, or a stale weights image would look like a cache hit.
+func TestWeightsCacheTagChangesWithContent(t *testing.T) {
+	weightsPath := filepath.Join(t.TempDir(), "weights.bin")
+	if err := os.WriteFile(weightsPath, []byte("v1"), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	g, err := NewGenerator(&config.Config{Build: &config.Build{PythonVersion: "3.10"}}, t.TempDir())
+	if err != nil {
+		t.Fatalf("NewGenerator: %v", err)
+	}
+	defer g.Cleanup()
+	g.modelFiles = []string{weightsPath}
+
+	tagV1, err := g.WeightsCacheTag()
+	if err != nil {
+		t.Fatalf("WeightsCacheTag: %v", err)
+	}
+
+	if err := os.WriteFile(weightsPath, []byte("v2-retrained"), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	tagV2, err := g.WeightsCacheTag()
+	if err != nil {
+		t.Fatalf("WeightsCacheTag: %v", err)
+	}
+
+	if tagV1 == tagV2 {
+		t.Errorf("expected the cache tag to change when weight file content changes at the same path, got %s for both", tagV1)
+	}
+}
@@ -0,0 +1,91 @@
+package dockerfile
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// micromambaVersion pins the Micromamba release used to materialize build.conda
+// environments, so conda builds are as reproducible as the pip-deps stage.
+const micromambaVersion = "1.5.8"
+
+// usingConda reports whether the generator should build the Python environment from
+// build.conda instead of pip/pyenv. It's mutually exclusive with the cog base images,
+// which already ship a fixed Python/Torch/CUDA combination.
+func (g *Generator) usingConda() bool {
+	return g.Config.Build.Conda != nil && !g.useCogBaseImage
+}
+
+// UsingConda reports whether the generator is building the "deps" stage from build.conda
+// rather than pip, for callers outside this package (e.g. pkg/cli deciding whether
+// PipDepsCacheTag applies to the current build).
+func (g *Generator) UsingConda() bool {
+	return g.usingConda()
+}
+
+// condaEnvironmentYAML resolves build.conda to the environment.yml contents Micromamba
+// should create the environment from, either by reading the configured file verbatim or
+// by rendering the inline channels/dependencies block.
+func (g *Generator) condaEnvironmentYAML() (string, error) {
+	conda := g.Config.Build.Conda
+
+	if conda.EnvironmentFile != "" {
+		contents, err := os.ReadFile(filepath.Join(g.Dir, conda.EnvironmentFile))
+		if err != nil {
+			return "", fmt.Errorf("Failed to read build.conda environment file %s: %w", conda.EnvironmentFile, err)
+		}
+		return string(contents), nil
+	}
+
+	var b strings.Builder
+	b.WriteString("name: cog\n")
+	if len(conda.Channels) > 0 {
+		b.WriteString("channels:\n")
+		for _, channel := range conda.Channels {
+			fmt.Fprintf(&b, "  - %s\n", channel)
+		}
+	}
+	if len(conda.Dependencies) > 0 {
+		b.WriteString("dependencies:\n")
+		for _, dep := range conda.Dependencies {
+			fmt.Fprintf(&b, "  - %s\n", dep)
+		}
+	}
+	return b.String(), nil
+}
+
+// condaInstallStage is the conda analogue of pipInstallStage: it builds a "deps" stage
+// that materializes the configured environment into /opt/conda/envs/cog, so the final
+// stage (itself built on the micromamba base image, see BaseImage) only needs that prefix
+// copied in.
+func (g *Generator) condaInstallStage() (string, error) {
+	environmentYAML, err := g.condaEnvironmentYAML()
+	if err != nil {
+		return "", err
+	}
+
+	copyLine, containerPath, err := g.writeTemp("environment.yml", []byte(environmentYAML))
+	if err != nil {
+		return "", err
+	}
+
+	lines := []string{
+		`FROM mambaorg/micromamba:` + micromambaVersion + ` as deps`,
+		// The upstream micromamba image switches to an unprivileged USER by default; apt
+		// and useradd downstream of this stage need root, so undo that switch here too.
+		`USER root`,
+		copyLine[0],
+		`RUN --mount=type=cache,target=/opt/conda/pkgs micromamba create -y -p /opt/conda/envs/cog -f ` + containerPath + ` && micromamba clean --all --yes`,
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// copyCondaPackagesFromInstallStage copies the materialized conda prefix from the deps
+// stage into the final image and puts it on PATH, mirroring
+// copyPipPackagesFromInstallStage but for a conda environment rather than a pip target dir.
+func (g *Generator) copyCondaPackagesFromInstallStage() string {
+	return `COPY --from=deps --link /opt/conda/envs/cog /opt/conda/envs/cog
+ENV PATH="/opt/conda/envs/cog/bin:$PATH"`
+}
@@ -16,6 +16,8 @@ import (
 	"github.com/replicate/cog/pkg/util/slices"
 	"github.com/replicate/cog/pkg/util/version"
 	"github.com/replicate/cog/pkg/weights"
+
+	"github.com/startingapr21/rogue/pkg/dockerfile/blocks"
 )
 
 //go:embed embed/cog.whl
@@ -66,6 +68,14 @@ type Generator struct {
 	modelFiles []string
 
 	pythonRequirementsContents string
+
+	// extraBlocks are additional building blocks registered via RegisterBlock, rendered
+	// alongside cogBaseImagePipeline for useCogBaseImage builds.
+	extraBlocks []blocks.Block
+
+	// cacheRegistryOverride is the registry/repository prefix cache tags are minted under,
+	// set via SetCacheRegistry. Empty means DefaultCacheRegistry.
+	cacheRegistryOverride string
 }
 
 func NewGenerator(config *config.Config, dir string) (*Generator, error) {
@@ -116,11 +126,21 @@ func (g *Generator) generateInitialSteps() (string, error) {
 	if err != nil {
 		return "", err
 	}
-	installPython, err := g.installPython()
-	if err != nil {
-		return "", err
+
+	if g.useCogBaseImage {
+		ctx, err := g.cogBaseImageBuildContext(baseImage)
+		if err != nil {
+			return "", err
+		}
+		pipeline := append(append([]blocks.Block{}, cogBaseImagePipeline...), g.extraBlocks...)
+		body, err := blocks.Render(pipeline, ctx)
+		if err != nil {
+			return "", err
+		}
+		return "#syntax=docker/dockerfile:1.4\n" + body, nil
 	}
-	aptInstalls, err := g.aptInstalls()
+
+	installPython, err := g.installPython()
 	if err != nil {
 		return "", err
 	}
@@ -129,35 +149,60 @@ func (g *Generator) generateInitialSteps() (string, error) {
 		return "", err
 	}
 
-	if g.useCogBaseImage {
-		pipInstalls, err := g.pipInstalls()
+	var depsStage, copyDeps string
+	if g.usingConda() {
+		depsStage, err = g.condaInstallStage()
 		if err != nil {
 			return "", err
 		}
-		return joinStringsWithoutLineSpace([]string{
-			"#syntax=docker/dockerfile:1.4",
-			"FROM " + baseImage,
-			aptInstalls,
-			pipInstalls,
-			runCommands,
-		}), nil
+		copyDeps = g.copyCondaPackagesFromInstallStage()
+	} else {
+		depsStage, err = g.pipInstallStage()
+		if err != nil {
+			return "", err
+		}
+		copyDeps = g.copyPipPackagesFromInstallStage()
 	}
 
-	pipInstallStage, err := g.pipInstallStage()
+	// system_packages get their own content-addressed stage (see aptInstallStage) so an
+	// unchanged package list can reuse a cached apt layer; the main stage then builds on
+	// top of that stage instead of baseImage directly.
+	aptStage, err := g.aptInstallStage(baseImage)
+	if err != nil {
+		return "", err
+	}
+	mainFrom := "FROM " + baseImage
+	if aptStage != "" {
+		mainFrom = "FROM apt-deps"
+	}
+	if g.usingConda() {
+		// The upstream micromamba base image already switches to an unprivileged USER;
+		// apt-get and the createUserAccount useradd call below both need root.
+		mainFrom += "\nUSER root"
+	}
+
+	ctx := &blocks.BuildContext{}
+	if g.usesNonRootUser() {
+		ctx.UserName, ctx.UserUID, ctx.UserGID = g.runtimeUser()
+	}
+	extraBlocks, err := g.renderExtraBlocks(ctx)
 	if err != nil {
 		return "", err
 	}
 
 	return joinStringsWithoutLineSpace([]string{
 		"#syntax=docker/dockerfile:1.4",
-		pipInstallStage,
-		"FROM " + baseImage,
+		depsStage,
+		aptStage,
+		mainFrom,
 		g.preamble(),
 		g.installTini(),
 		installPython,
-		aptInstalls,
-		g.copyPipPackagesFromInstallStage(),
+		copyDeps,
+		g.createUserAccount(),
+		g.switchToRuntimeUser(),
 		runCommands,
+		extraBlocks,
 	}), nil
 }
 
@@ -182,7 +227,7 @@ func (g *Generator) GenerateDockerfileWithoutSeparateWeights() (string, error) {
 	}
 	return joinStringsWithoutLineSpace([]string{
 		base,
-		`COPY . /src`,
+		`COPY ` + g.copyChownFlag() + `. /src`,
 	}), nil
 }
 
@@ -215,15 +260,19 @@ func (g *Generator) GenerateModelBaseWithSeparateWeights(imageName string) (weig
 		}
 	}
 
-	for _, p := range append(g.modelDirs, g.modelFiles...) {
-		base = append(base, "COPY --from=weights --link "+path.Join("/src", p)+" "+path.Join("/src", p))
+	if !g.useCogBaseImage {
+		// useCogBaseImage builds already got this COPY from WeightsCopyBlock, rendered as
+		// part of initialSteps above via cogBaseImageBuildContext's ModelPaths.
+		for _, p := range append(g.modelDirs, g.modelFiles...) {
+			base = append(base, "COPY --from=weights --link "+g.copyChownFlag()+path.Join("/src", p)+" "+path.Join("/src", p))
+		}
 	}
 
 	base = append(base,
 		`WORKDIR /src`,
 		`EXPOSE 5000`,
 		`CMD ["python", "-m", "cog.server.http"]`,
-		`COPY . /src`,
+		`COPY `+g.copyChownFlag()+`. /src`,
 	)
 
 	dockerignoreContents = makeDockerignoreForWeights(g.modelDirs, g.modelFiles)
@@ -298,6 +347,19 @@ func (g *Generator) BaseImage() (string, error) {
 		return baseImage, nil
 	}
 
+	if g.usingConda() {
+		return "mambaorg/micromamba:" + micromambaVersion, nil
+	}
+
+	if g.usingROCm() && g.useCudaBaseImage {
+		torchVersion, _ := g.Config.TorchVersion()
+		rocmGen, err := newROCmBaseImageGenerator(g.Config.Build.ROCM, g.Config.Build.PythonVersion, torchVersion)
+		if err != nil {
+			return "", err
+		}
+		return rocmBaseImageName(rocmGen.rocmVersion), nil
+	}
+
 	if g.Config.Build.GPU && g.useCudaBaseImage {
 		return g.Config.CUDABaseImageTag()
 	}
@@ -305,6 +367,13 @@ func (g *Generator) BaseImage() (string, error) {
 }
 
 func (g *Generator) preamble() string {
+	if g.usingROCm() {
+		return strings.Join([]string{
+			`ENV DEBIAN_FRONTEND=noninteractive`,
+			`ENV PYTHONUNBUFFERED=1`,
+			g.rocmEnv(),
+		}, "\n")
+	}
 	return `ENV DEBIAN_FRONTEND=noninteractive
 ENV PYTHONUNBUFFERED=1
 ENV LD_LIBRARY_PATH=$LD_LIBRARY_PATH:/usr/lib/x86_64-linux-gnu:/usr/local/nvidia/lib64:/usr/local/nvidia/bin
@@ -348,7 +417,37 @@ func (g *Generator) aptInstalls() (string, error) {
 		" && rm -rf /var/lib/apt/lists/*", nil
 }
 
+// aptInstallStage builds system_packages in a dedicated, content-addressed "apt-deps"
+// stage instead of inline in the final image, so an unchanged package list can reuse a
+// previously built (and possibly pulled) apt layer across builds. It returns "" when
+// there are no system packages to install.
+func (g *Generator) aptInstallStage(baseImage string) (string, error) {
+	packages := g.Config.Build.SystemPackages
+	if len(packages) == 0 {
+		return "", nil
+	}
+
+	fromLine, hit := resolveCachedStage("FROM "+baseImage+" as apt-deps", "apt-deps", g.AptCacheTag(baseImage))
+	if g.usingConda() {
+		// The upstream micromamba base image already switches to an unprivileged USER.
+		fromLine += "\nUSER root"
+	}
+	if hit {
+		// The cache tag's image already has these packages installed; re-running apt-get
+		// would just redo the same work on top of itself.
+		return fromLine, nil
+	}
+	install := "RUN --mount=type=cache,target=/var/cache/apt,sharing=locked apt-get update -qq && apt-get install -qqy " +
+		strings.Join(packages, " ") +
+		" && rm -rf /var/lib/apt/lists/*"
+	return strings.Join([]string{fromLine, install}, "\n"), nil
+}
+
 func (g *Generator) installPython() (string, error) {
+	if g.usingConda() {
+		// Python comes from the materialized conda/mamba environment instead.
+		return "", nil
+	}
 	if g.Config.Build.GPU && g.useCudaBaseImage && !g.useCogBaseImage {
 		return g.installPythonCUDA()
 	}
@@ -419,6 +518,7 @@ func (g *Generator) pipInstalls() (string, error) {
 		return "", nil
 	}
 
+	g.pythonRequirementsContents = g.maybeAddROCmExtraIndex(g.pythonRequirementsContents)
 	console.Debugf("Generated requirements.txt:\n%s", g.pythonRequirementsContents)
 	copyLine, containerPath, err := g.writeTemp("requirements.txt", []byte(g.pythonRequirementsContents))
 	if err != nil {
@@ -447,6 +547,7 @@ func (g *Generator) pipInstallStage() (string, error) {
 ` + installCog, nil
 	}
 
+	g.pythonRequirementsContents = g.maybeAddROCmExtraIndex(g.pythonRequirementsContents)
 	console.Debugf("Generated requirements.txt:\n%s", g.pythonRequirementsContents)
 	copyLine, containerPath, err := g.writeTemp("requirements.txt", []byte(g.pythonRequirementsContents))
 	if err != nil {
@@ -460,8 +561,17 @@ func (g *Generator) pipInstallStage() (string, error) {
 	// this is a bodge to support that
 	// it will be reverted when we add custom dockerfiles
 	buildStageDeps := os.Getenv("COG_EXPERIMENTAL_BUILD_STAGE_DEPS")
+	hit := false
 	if buildStageDeps != "" {
 		fromLine = fromLine + "\nRUN " + buildStageDeps
+	} else {
+		torchVersion, _ := g.Config.TorchVersion()
+		tag := pipDepsStageCacheTag(g.cacheRegistry(), g.pythonRequirementsContents, g.Config.Build.PythonVersion, g.Config.Build.CUDA, torchVersion)
+		fromLine, hit = resolveCachedStage(fromLine, "deps", tag)
+	}
+	if hit {
+		// The cache tag's image already has cog and the requirements installed into /dep.
+		return fromLine, nil
 	}
 	lines := []string{
 		fromLine,
@@ -510,6 +620,7 @@ func (g *Generator) runCommands() (string, error) {
 This is the offending line: %s`, command)
 		}
 
+		var line string
 		if len(run.Mounts) > 0 {
 			mounts := []string{}
 			for _, mount := range run.Mounts {
@@ -518,10 +629,19 @@ This is the offending line: %s`, command)
 					mounts = append(mounts, secretMount)
 				}
 			}
-			lines = append(lines, fmt.Sprintf("RUN %s %s", strings.Join(mounts, " "), command))
+			line = fmt.Sprintf("RUN %s %s", strings.Join(mounts, " "), command)
 		} else {
-			lines = append(lines, "RUN "+command)
+			line = "RUN " + command
 		}
+
+		// Once we've dropped to a non-root user, a run: step that needs root (installing
+		// system packages, writing outside /src, etc.) has to ask for it explicitly.
+		if g.usesNonRootUser() && run.Privileged {
+			name, _, _ := g.runtimeUser()
+			line = strings.Join([]string{"USER root", line, "USER " + name}, "\n")
+		}
+
+		lines = append(lines, line)
 	}
 	return strings.Join(lines, "\n"), nil
 }
@@ -0,0 +1,92 @@
+package dockerfile
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/replicate/cog/pkg/util/slices"
+)
+
+// rocmTorchMatrix enumerates the ROCm x Torch combinations we build cog-compatible
+// images for. Unlike the CUDA matrix, ROCm torch wheels are published to PyTorch's own
+// rocm<ver> wheel index rather than PyPI, which is why pipInstalls has to special-case them.
+var rocmTorchMatrix = map[string][]string{
+	"5.6": {"2.0", "2.1"},
+	"5.7": {"2.0", "2.1", "2.2"},
+	"6.0": {"2.2", "2.3"},
+}
+
+// rocmBaseImageGenerator validates a ROCm/Python/Torch combination against
+// rocmTorchMatrix, mirroring the role NewBaseImageGenerator plays for the CUDA matrix.
+type rocmBaseImageGenerator struct {
+	rocmVersion   string
+	pythonVersion string
+	torchVersion  string
+}
+
+func newROCmBaseImageGenerator(rocmVersion, pythonVersion, torchVersion string) (*rocmBaseImageGenerator, error) {
+	torchVersions, ok := rocmTorchMatrix[rocmVersion]
+	if !ok {
+		return nil, fmt.Errorf("ROCm version %s is not supported. Supported versions: %s", rocmVersion, supportedROCmVersions())
+	}
+	if torchVersion != "" && !slices.ContainsString(torchVersions, torchVersion) {
+		return nil, fmt.Errorf("torch %s is not available for ROCm %s. Supported torch versions: %s", torchVersion, rocmVersion, strings.Join(torchVersions, ", "))
+	}
+	return &rocmBaseImageGenerator{
+		rocmVersion:   rocmVersion,
+		pythonVersion: pythonVersion,
+		torchVersion:  torchVersion,
+	}, nil
+}
+
+func supportedROCmVersions() string {
+	versions := make([]string, 0, len(rocmTorchMatrix))
+	for v := range rocmTorchMatrix {
+		versions = append(versions, v)
+	}
+	sort.Strings(versions)
+	return strings.Join(versions, ", ")
+}
+
+// rocmBaseImageName returns the rocm/dev-ubuntu-* tag to build from. Python itself still
+// comes from installPythonCUDA's pyenv install, same as the existing CUDA path.
+func rocmBaseImageName(rocmVersion string) string {
+	return "rocm/dev-ubuntu-22.04:" + rocmVersion + "-complete"
+}
+
+// rocmPipExtraIndexURL returns the --extra-index-url pip needs to resolve a ROCm build of
+// torch, since those wheels aren't published to PyPI.
+func rocmPipExtraIndexURL(rocmVersion string) string {
+	return "https://download.pytorch.org/whl/rocm" + rocmVersion
+}
+
+// rocmEnv renders the ROCm-specific preamble ENV lines. HSA_OVERRIDE_GFX_VERSION tells
+// ROCm to treat the device as a gfx architecture it wasn't built to target -- it's only
+// correct for the handful of consumer/workstation cards that need it (e.g. RDNA2's
+// gfx1030), and wrong for the datacenter/CDNA cards (MI100/MI200/MI300-class) this is
+// otherwise used for, so it's only emitted when build.rocm_gfx_version asks for it
+// explicitly rather than assumed for every ROCm build.
+func (g *Generator) rocmEnv() string {
+	lines := []string{`ENV ROCM_PATH=/opt/rocm`}
+	if gfx := g.Config.Build.ROCMGfxVersion; gfx != "" {
+		lines = append(lines, `ENV HSA_OVERRIDE_GFX_VERSION=`+gfx)
+	}
+	lines = append(lines, `ENV LD_LIBRARY_PATH=$LD_LIBRARY_PATH:/opt/rocm/lib`)
+	return strings.Join(lines, "\n")
+}
+
+// usingROCm reports whether the build targets AMD/ROCm GPUs instead of the default CUDA
+// path.
+func (g *Generator) usingROCm() bool {
+	return g.Config.Build.GPU && g.Config.Build.GPUVendor == "amd"
+}
+
+// maybeAddROCmExtraIndex prepends the ROCm torch wheel index to a requirements.txt body
+// when the build targets ROCm, so `pip install -r requirements.txt` can resolve torch.
+func (g *Generator) maybeAddROCmExtraIndex(requirements string) string {
+	if !g.usingROCm() || strings.TrimSpace(requirements) == "" {
+		return requirements
+	}
+	return "--extra-index-url " + rocmPipExtraIndexURL(g.Config.Build.ROCM) + "\n" + requirements
+}
@@ -0,0 +1,215 @@
+package dockerfile
+
+import (
+	"fmt"
+	"strings"
+)
+
+// GenerateSingularityDef generates an Apptainer/Singularity recipe equivalent to the
+// Dockerfile produced by GenerateDockerfileWithoutSeparateWeights, for HPC users who can
+// build with `apptainer build` but don't have a Docker daemon available.
+func (g *Generator) GenerateSingularityDef() (string, error) {
+	def, err := g.singularityRecipe()
+	if err != nil {
+		return "", err
+	}
+	return strings.Join([]string{
+		def,
+		`%files`,
+		`    . /src`,
+	}, "\n"), nil
+}
+
+// GenerateSingularityDefWithSeparateWeights is the Singularity counterpart to
+// GenerateModelBaseWithSeparateWeights: it returns a standalone weights recipe plus a main
+// recipe that pulls the weights in from a previously-built local .sif (via "Bootstrap:
+// localimage") rather than a registry image, so weight files don't have to be re-copied
+// into the final recipe's %files section by hand and building the main recipe doesn't
+// require a Docker daemon or registry access — the dependency this feature exists to avoid
+// for HPC users. sifName is the already-built weights .sif's path, e.g. the output of
+// `apptainer build <sifName> -` on the returned weightsDef.
+func (g *Generator) GenerateSingularityDefWithSeparateWeights(sifName string) (weightsDef string, def string, err error) {
+	_, g.modelDirs, g.modelFiles, err = g.generateForWeights()
+	if err != nil {
+		return "", "", fmt.Errorf("Failed to generate Singularity recipe for model weights files: %w", err)
+	}
+
+	// "Bootstrap: docker" with "From: scratch" would ask Apptainer's docker bootstrap agent
+	// to resolve "scratch" as a real registry reference, which fails -- unlike the Docker
+	// daemon, Apptainer has no special case for it. "Bootstrap: scratch" is Apptainer's own
+	// no-base equivalent: an empty root filesystem %files can be copied into directly.
+	weightsLines := []string{
+		`Bootstrap: scratch`,
+		``,
+		`%files`,
+	}
+	for _, p := range append(g.modelDirs, g.modelFiles...) {
+		weightsLines = append(weightsLines, fmt.Sprintf("    %s %s", p, pathJoinSrc(p)))
+	}
+	weightsDef = strings.Join(weightsLines, "\n")
+
+	spec, err := g.singularityRecipe()
+	if err != nil {
+		return "", "", err
+	}
+
+	lines := []string{
+		`Bootstrap: localimage`,
+		`From: ` + sifName,
+		`Stage: weights`,
+		``,
+		spec,
+		`%files from weights`,
+	}
+	for _, p := range append(g.modelDirs, g.modelFiles...) {
+		lines = append(lines, fmt.Sprintf("    %s %s", pathJoinSrc(p), pathJoinSrc(p)))
+	}
+
+	return weightsDef, strings.Join(lines, "\n"), nil
+}
+
+// singularityRecipe renders the shared header/%post/%environment/%runscript/%labels
+// sections that both single-stage and weights-separated recipes build on top of.
+func (g *Generator) singularityRecipe() (string, error) {
+	baseImage, err := g.BaseImage()
+	if err != nil {
+		return "", err
+	}
+
+	post, err := g.singularityPost()
+	if err != nil {
+		return "", err
+	}
+
+	return strings.Join([]string{
+		`Bootstrap: docker`,
+		`From: ` + baseImage,
+		`Stage: spec`,
+		``,
+		`%post`,
+		post,
+		``,
+		`%environment`,
+		dockerEnvToSingularityEnv(g.preamble()),
+		``,
+		`%runscript`,
+		g.singularityRunscript(),
+		``,
+		`%labels`,
+		`    org.cogmodel.singularity true`,
+	}, "\n"), nil
+}
+
+// singularityPost translates the RUN steps generateInitialSteps would otherwise emit as
+// Docker layers into a single %post script, since Singularity recipes don't have a
+// multi-stage pip-install-stage concept to copy from.
+func (g *Generator) singularityPost() (string, error) {
+	installPython, err := g.installPython()
+	if err != nil {
+		return "", err
+	}
+	aptInstalls, err := g.aptInstalls()
+	if err != nil {
+		return "", err
+	}
+	pipInstalls, err := g.pipInstalls()
+	if err != nil {
+		return "", err
+	}
+	runCommands, err := g.runCommands()
+	if err != nil {
+		return "", err
+	}
+
+	// createUserAccount provisions the configured runtime user; %post always runs as root
+	// regardless, so unlike generateInitialSteps there's no Docker-style USER switch to
+	// translate here -- g.switchToRuntimeUser's build.user only takes effect once
+	// singularityRunscript execs into it.
+	steps := []string{
+		dockerRunToSingularityPost(g.installTini()),
+		dockerRunToSingularityPost(installPython),
+		dockerRunToSingularityPost(aptInstalls),
+		dockerRunToSingularityPost(pipInstalls),
+		dockerRunToSingularityPost(g.createUserAccount()),
+		dockerRunToSingularityPost(runCommands),
+	}
+	return strings.Join(filterEmpty(steps), "\n"), nil
+}
+
+// singularityRunscript execs the cog HTTP server as the configured runtime user when
+// build.user is set, mirroring the USER switch generateInitialSteps applies to the
+// Dockerfile path; otherwise it runs as the container's default user (root).
+func (g *Generator) singularityRunscript() string {
+	cmd := `python -m cog.server.http "$@"`
+	if !g.usesNonRootUser() {
+		return "    exec " + cmd
+	}
+	name, _, _ := g.runtimeUser()
+	// `su -c '<cmd>'` does not forward the runscript's own "$@" into the shell it spawns --
+	// the trailing `-- "$@"` passes them as su's own positional args instead, which su in
+	// turn makes available to -c's command as its "$@".
+	return fmt.Sprintf(`    exec su %s -c '%s' -- "$@"`, name, cmd)
+}
+
+// dockerRunToSingularityPost strips Docker-specific RUN syntax (the RUN keyword and
+// --mount=... buildkit flags) and translates ENV lines to shell `export`s so the remaining
+// commands can run verbatim inside a Singularity %post script. ENV has to be re-emitted
+// here, not just folded into %environment: %post runs its own shell, separate from the one
+// %environment configures at runtime, and later commands in the same %post script (e.g.
+// installPythonCUDA's bare `pyenv` invocations) depend on PATH entries an earlier ENV line
+// set.
+func dockerRunToSingularityPost(dockerfileSnippet string) string {
+	lines := []string{}
+	for _, line := range strings.Split(dockerfileSnippet, "\n") {
+		switch {
+		case strings.HasPrefix(line, "RUN "):
+			line = strings.TrimPrefix(line, "RUN ")
+			line = stripMountFlags(line)
+			lines = append(lines, line)
+		case strings.HasPrefix(line, "ENV "):
+			lines = append(lines, "export "+strings.TrimPrefix(line, "ENV "))
+		case strings.HasPrefix(line, "ENTRYPOINT"), strings.HasPrefix(line, "COPY "), strings.HasPrefix(line, "USER "):
+			// ENTRYPOINT has no Singularity equivalent (the recipe's own runscript/startscript
+			// cover PID 1 instead); COPY is handled by %files; USER switches are meaningless in
+			// %post (which always runs as root) and are instead applied in singularityRunscript.
+			continue
+		default:
+			if strings.TrimSpace(line) != "" {
+				lines = append(lines, line)
+			}
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func stripMountFlags(runBody string) string {
+	fields := strings.Fields(runBody)
+	kept := []string{}
+	for _, f := range fields {
+		if strings.HasPrefix(f, "--mount=") {
+			continue
+		}
+		kept = append(kept, f)
+	}
+	return strings.Join(kept, " ")
+}
+
+// dockerEnvToSingularityEnv turns a block of `ENV NAME=value` Dockerfile lines into the
+// bare `export NAME=value` shell statements %environment expects.
+func dockerEnvToSingularityEnv(dockerfileSnippet string) string {
+	lines := []string{}
+	for _, line := range strings.Split(dockerfileSnippet, "\n") {
+		if !strings.HasPrefix(line, "ENV ") {
+			continue
+		}
+		lines = append(lines, "    export "+strings.TrimPrefix(line, "ENV "))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func pathJoinSrc(p string) string {
+	if strings.HasPrefix(p, "/src/") {
+		return p
+	}
+	return "/src/" + strings.TrimPrefix(p, "/")
+}
@@ -0,0 +1,33 @@
+package dockerfile
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/replicate/cog/pkg/config"
+)
+
+// TestSingularityRunscriptForwardsArgsForNonRootUser guards against a regression where
+// `su -c` swallowed the runscript's own "$@" instead of handing it to the server -- `su`
+// only makes positional args available to -c's command when they're passed as su's own
+// trailing arguments.
+func TestSingularityRunscriptForwardsArgsForNonRootUser(t *testing.T) {
+	cfg := &config.Config{
+		Build: &config.Build{
+			PythonVersion: "3.10",
+			User:          &config.User{Name: "cog", UID: 1000, GID: 1000},
+		},
+	}
+
+	g, err := NewGenerator(cfg, t.TempDir())
+	if err != nil {
+		t.Fatalf("NewGenerator: %v", err)
+	}
+	defer g.Cleanup()
+
+	runscript := g.singularityRunscript()
+	const want = `su cog -c 'python -m cog.server.http "$@"' -- "$@"`
+	if !strings.Contains(runscript, want) {
+		t.Errorf("expected runscript to forward args via a trailing -- \"$@\", got %q", runscript)
+	}
+}
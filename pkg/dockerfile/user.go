@@ -0,0 +1,83 @@
+package dockerfile
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Defaults applied when build.user is set without an explicit name/uid/gid.
+const (
+	defaultRuntimeUserName = "cog"
+	defaultRuntimeUID      = 1000
+	defaultRuntimeGID      = 1000
+)
+
+// usesNonRootUser reports whether the generated image should provision and run as an
+// unprivileged user instead of root.
+func (g *Generator) usesNonRootUser() bool {
+	return g.Config.Build.User != nil
+}
+
+// runtimeUser resolves build.user against its defaults.
+func (g *Generator) runtimeUser() (name string, uid int, gid int) {
+	user := g.Config.Build.User
+	name = user.Name
+	if name == "" {
+		name = defaultRuntimeUserName
+	}
+	uid = user.UID
+	if uid == 0 {
+		uid = defaultRuntimeUID
+	}
+	gid = user.GID
+	if gid == 0 {
+		gid = defaultRuntimeGID
+	}
+	return name, uid, gid
+}
+
+// createUserAccount emits the groupadd/useradd/chown sequence that provisions the
+// configured runtime user and hands ownership of /src over to it. It must run while the
+// image is still root, so it's emitted before switchToRuntimeUser in generateInitialSteps.
+func (g *Generator) createUserAccount() string {
+	if !g.usesNonRootUser() {
+		return ""
+	}
+	name, uid, gid := g.runtimeUser()
+
+	ownedPaths := []string{"/src"}
+	switch {
+	case g.Config.Build.GPU && g.useCudaBaseImage && !g.useCogBaseImage:
+		ownedPaths = append(ownedPaths, "/root/.pyenv")
+	case !g.useCogBaseImage && !g.usingConda():
+		ownedPaths = append(ownedPaths, "/usr/local/lib/python"+g.Config.Build.PythonVersion+"/site-packages")
+	case g.usingConda():
+		ownedPaths = append(ownedPaths, "/opt/conda/envs/cog")
+	}
+
+	return fmt.Sprintf(`RUN groupadd -g %d %s && useradd -m -u %d -g %d %s
+RUN mkdir -p /src && chown -R %s:%s %s`,
+		gid, name, uid, gid, name,
+		name, name, strings.Join(ownedPaths, " "))
+}
+
+// switchToRuntimeUser emits the USER directive that drops privileges for the rest of the
+// build and the eventual CMD. Tini still runs as PID 1 and execs into this user.
+func (g *Generator) switchToRuntimeUser() string {
+	if !g.usesNonRootUser() {
+		return ""
+	}
+	name, _, _ := g.runtimeUser()
+	return "USER " + name
+}
+
+// copyChownFlag returns the `--chown=user:user ` flag COPY instructions need so files
+// copied after the USER switch (which COPY otherwise defaults to root:root regardless of
+// the active USER) end up owned by the runtime user.
+func (g *Generator) copyChownFlag() string {
+	if !g.usesNonRootUser() {
+		return ""
+	}
+	name, _, _ := g.runtimeUser()
+	return "--chown=" + name + ":" + name + " "
+}